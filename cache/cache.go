@@ -0,0 +1,106 @@
+// Package cache provides a small in-memory TTL cache used to avoid
+// re-checking GitLab projects for pages jobs on every scrape when nothing
+// about the project has changed since the last successful check.
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry holds the cached result of the last successful pages job check for
+// a project.
+type Entry struct {
+	// LastActivityAt is the project's last_activity_at as reported by the
+	// GitLab API at the time this entry was stored. If the project's current
+	// last_activity_at does not match this value the entry is considered
+	// stale, since something about the project changed since the last check.
+	LastActivityAt time.Time
+	// HasPagesJob is the cached result of the pages job check.
+	HasPagesJob bool
+	// CheckState is the cached check state, stored as its string
+	// representation so this package does not need to depend on the
+	// exporter package.
+	CheckState string
+
+	cachedAt time.Time
+}
+
+// ProjectCache is a TTL cache of pages job check results, keyed by project
+// ID. It is safe for concurrent use.
+type ProjectCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[int]Entry
+}
+
+// New creates a new ProjectCache whose entries expire after ttl. A ttl of
+// zero or less disables expiry based eviction, entries are still replaced
+// whenever a project's last_activity_at changes.
+func New(ttl time.Duration) *ProjectCache {
+	return &ProjectCache{
+		ttl:     ttl,
+		entries: make(map[int]Entry),
+	}
+}
+
+// Get looks up the cached entry for projectID. ok is false if there is no
+// entry, the entry has expired, or lastActivityAt no longer matches the
+// cached value, any of which mean the project must be checked again.
+func (c *ProjectCache) Get(projectID int, lastActivityAt time.Time) (entry Entry, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, found := c.entries[projectID]
+	if !found {
+		return Entry{}, false
+	}
+	if c.ttl > 0 && time.Since(entry.cachedAt) > c.ttl {
+		return Entry{}, false
+	}
+	if !entry.LastActivityAt.Equal(lastActivityAt) {
+		return Entry{}, false
+	}
+
+	return entry, true
+}
+
+// Set stores the result of a pages job check for projectID.
+func (c *ProjectCache) Set(projectID int, lastActivityAt time.Time, hasPagesJob bool, checkState string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[projectID] = Entry{
+		LastActivityAt: lastActivityAt,
+		HasPagesJob:    hasPagesJob,
+		CheckState:     checkState,
+		cachedAt:       time.Now(),
+	}
+}
+
+// Evict removes all expired entries from the cache and returns how many
+// were removed.
+func (c *ProjectCache) Evict() int {
+	if c.ttl <= 0 {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	evicted := 0
+	for id, entry := range c.entries {
+		if time.Since(entry.cachedAt) > c.ttl {
+			delete(c.entries, id)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Len returns the number of entries currently held in the cache.
+func (c *ProjectCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
@@ -0,0 +1,133 @@
+// Package config loads the exporter's configuration from a YAML or TOML
+// file, mirroring the schema used by gitaly-blackbox and yanic. GPE_*
+// environment variables remain supported and are applied on top of the file
+// as an override layer.
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// GitlabConfig holds how to reach the GitLab instance to scrape.
+type GitlabConfig struct {
+	// APIURL is the base URL of the GitLab instance, e.g. https://gitlab.com.
+	APIURL string `yaml:"api_url" toml:"api_url"`
+	// Token is the GitLab admin read token used to authenticate API calls.
+	Token string `yaml:"token" toml:"token"`
+	// TokenFile, if set, is read instead of Token, e.g. to point at a
+	// Kubernetes secret mounted as a file.
+	TokenFile string `yaml:"token_file" toml:"token_file"`
+}
+
+// ScheduleConfig holds when the exporter scrapes the GitLab instance.
+type ScheduleConfig struct {
+	// Cron is the schedule in standard cron syntax.
+	Cron string `yaml:"cron" toml:"cron"`
+}
+
+// ListenConfig holds the addresses the exporter listens on.
+type ListenConfig struct {
+	// MetricsAddr is where /metrics is served.
+	MetricsAddr string `yaml:"metrics_addr" toml:"metrics_addr"`
+	// AdminAddr, if set, serves /healthz and /ready on a separate listener
+	// instead of alongside /metrics.
+	AdminAddr string `yaml:"admin_addr" toml:"admin_addr"`
+}
+
+// FiltersConfig bounds which projects are checked for pages, so one
+// instance can be scoped to a subset of a large GitLab instance. Custom
+// domains, and the probes of them, are not filtered.
+type FiltersConfig struct {
+	// IncludeGroups limits scraping to projects in one of these top-level
+	// or nested group paths. Empty means all groups are included.
+	IncludeGroups []string `yaml:"include_groups" toml:"include_groups"`
+	// ExcludeGroups removes projects in one of these group paths.
+	ExcludeGroups []string `yaml:"exclude_groups" toml:"exclude_groups"`
+	// IncludeProjectIDs limits scraping to these project IDs. Empty means
+	// all project IDs are included.
+	IncludeProjectIDs []int `yaml:"include_project_ids" toml:"include_project_ids"`
+	// ExcludeProjectIDs removes these project IDs.
+	ExcludeProjectIDs []int `yaml:"exclude_project_ids" toml:"exclude_project_ids"`
+	// Visibility limits scraping to projects with one of these visibility
+	// levels (public, internal, private). Empty means all visibilities are
+	// included.
+	Visibility []string `yaml:"visibility" toml:"visibility"`
+}
+
+// Config is the root of the exporter's file based configuration.
+type Config struct {
+	Gitlab   GitlabConfig   `yaml:"gitlab" toml:"gitlab"`
+	Schedule ScheduleConfig `yaml:"schedule" toml:"schedule"`
+	Listen   ListenConfig   `yaml:"listen" toml:"listen"`
+	Filters  FiltersConfig  `yaml:"filters" toml:"filters"`
+
+	// SetAllProjectMetrics defines if all projects should be added to
+	// prometheus metrics or only the ones actually exposing pages.
+	SetAllProjectMetrics bool `yaml:"set_all_project_metrics" toml:"set_all_project_metrics"`
+}
+
+// Load reads and parses the config file at path. The format is chosen based
+// on the file extension (.yaml/.yml or .toml). If gitlab.token_file is set
+// its contents are read into gitlab.token.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	cfg := &Config{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML config file %s: %w", path, err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse TOML config file %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q, expected .yaml, .yml or .toml", ext)
+	}
+
+	if cfg.Gitlab.TokenFile != "" {
+		token, err := os.ReadFile(cfg.Gitlab.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gitlab.token_file %s: %w", cfg.Gitlab.TokenFile, err)
+		}
+		cfg.Gitlab.Token = strings.TrimSpace(string(token))
+	}
+
+	return cfg, nil
+}
+
+// ApplyEnvOverrides overlays the GPE_* environment variables on top of c, so
+// env vars keep working as an override layer on top of a config file.
+func (c *Config) ApplyEnvOverrides() error {
+	if v := os.Getenv("GPE_GITLAB_API_URL"); v != "" {
+		c.Gitlab.APIURL = v
+	}
+	if v := os.Getenv("GPE_GITLAB_ADMIN_READ_TOKEN"); v != "" {
+		c.Gitlab.Token = v
+	}
+	if v := os.Getenv("GPE_CRON_SCHEDULE"); v != "" {
+		c.Schedule.Cron = v
+	}
+	if v := os.Getenv("GPE_ADMIN_LISTEN_ADDR"); v != "" {
+		c.Listen.AdminAddr = v
+	}
+	if v := os.Getenv("GPE_SET_ALL_PROJECT_METRICS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("GPE_SET_ALL_PROJECT_METRICS must be a valid boolean value: %w", err)
+		}
+		c.SetAllProjectMetrics = b
+	}
+	return nil
+}
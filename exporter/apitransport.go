@@ -0,0 +1,120 @@
+package exporter
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitConfig configures the token-bucket limiter applied to outgoing
+// GitLab API requests.
+type RateLimitConfig struct {
+	// RequestsPerSecond is the sustained rate of GitLab API requests
+	// allowed, configurable via GPE_API_RATE_LIMIT. Zero or negative
+	// disables rate limiting.
+	RequestsPerSecond float64
+	// Burst is the maximum number of requests allowed to burst past
+	// RequestsPerSecond, configurable via GPE_API_RATE_BURST.
+	Burst int
+}
+
+// apiRequestMetrics holds the prometheus collectors tracking outgoing
+// GitLab API calls. CounterVec and HistogramVec already implement
+// prometheus.Collector, so these are simply forwarded from the exporter's
+// own Describe/Collect instead of being registered separately.
+type apiRequestMetrics struct {
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+}
+
+// newAPIRequestMetrics builds the (unregistered) collectors tracking
+// outgoing GitLab API calls.
+func newAPIRequestMetrics() *apiRequestMetrics {
+	return &apiRequestMetrics{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "gitlab_api_requests_total",
+			Help:      "Total number of requests made against the GitLab API, by endpoint and status",
+		}, []string{"endpoint", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "gitlab_api_request_duration_seconds",
+			Help:      "How long requests against the GitLab API took, by endpoint",
+		}, []string{"endpoint"}),
+	}
+}
+
+// rateLimitedTransport wraps an http.RoundTripper with a token-bucket rate
+// limiter and records request count/duration metrics, so operators can see
+// exactly how close the exporter is to hitting GitLab's rate ceiling.
+type rateLimitedTransport struct {
+	next    http.RoundTripper
+	limiter *rate.Limiter
+	metrics *apiRequestMetrics
+}
+
+// newRateLimitedTransport builds the RoundTripper used for every request the
+// gitlab.Client makes. limiter is nil, and therefore a no-op, unless cfg
+// configures a positive RequestsPerSecond.
+func newRateLimitedTransport(cfg RateLimitConfig, metrics *apiRequestMetrics) *rateLimitedTransport {
+	var limiter *rate.Limiter
+	if cfg.RequestsPerSecond > 0 {
+		burst := cfg.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(cfg.RequestsPerSecond), burst)
+	}
+
+	return &rateLimitedTransport{
+		next:    http.DefaultTransport,
+		limiter: limiter,
+		metrics: metrics,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.limiter != nil {
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint := apiEndpointLabel(req.URL.Path)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	t.metrics.requestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	t.metrics.requestsTotal.WithLabelValues(endpoint, status).Inc()
+
+	return resp, err
+}
+
+// apiEndpointLabel normalizes a GitLab API request path into a low
+// cardinality label, e.g. "/api/v4/projects/123/jobs" becomes
+// "projects/jobs", so per-project IDs never end up as a label value.
+func apiEndpointLabel(path string) string {
+	switch {
+	case strings.Contains(path, "/jobs"):
+		return "projects/jobs"
+	case strings.Contains(path, "/environments"):
+		return "projects/environments"
+	case strings.Contains(path, "/pages/domains"):
+		return "pages/domains"
+	case strings.Contains(path, "/version"):
+		return "version"
+	case strings.Contains(path, "/projects"):
+		return "projects"
+	default:
+		return "other"
+	}
+}
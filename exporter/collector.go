@@ -0,0 +1,176 @@
+package exporter
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricDescs holds the static descriptors for every metric the exporter
+// exposes. Descriptors are built once and reused for every Collect call.
+type metricDescs struct {
+	projectPages  *prometheus.Desc
+	customDomains *prometheus.Desc
+
+	projectPagesTotal  *prometheus.Desc
+	customDomainsTotal *prometheus.Desc
+	projectsChecked    *prometheus.Desc
+
+	checkState        *prometheus.Desc
+	lastCheckDuration *prometheus.Desc
+	lastCheckTime     *prometheus.Desc
+	nextCheckTime     *prometheus.Desc
+	numberOfScrapes   *prometheus.Desc
+
+	cacheHits    *prometheus.Desc
+	cacheMisses  *prometheus.Desc
+	cacheEntries *prometheus.Desc
+
+	probeStatusCode    *prometheus.Desc
+	probeDuration      *prometheus.Desc
+	probeTLSExpiry     *prometheus.Desc
+	probeSuccess       *prometheus.Desc
+	probeRedirectCount *prometheus.Desc
+	probeResponseSize  *prometheus.Desc
+}
+
+// newMetricDescs builds the descriptors for every metric the exporter
+// exposes.
+func newMetricDescs() *metricDescs {
+	projectLabels := []string{"project_id", "project_name", "project_web_url", "pages_access_level", "check_status"}
+	domainLabels := []string{"project_id", "pages_domain"}
+	probeLabels := []string{"project_id", "url"}
+
+	desc := func(name, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(PrometheusNamespace, "", name),
+			help,
+			labels,
+			nil,
+		)
+	}
+
+	return &metricDescs{
+		projectPages:  desc("project_pages_enabled", "If GitLab pages are enabled for the project", projectLabels),
+		customDomains: desc("custom_domains_verified", "Custom domain verification status", domainLabels),
+
+		projectPagesTotal:  desc("project_pages_total", "Shows the total number of projects which have pages deployed", nil),
+		customDomainsTotal: desc("custom_domains_total", "Shows the total number of custom domains added", nil),
+		projectsChecked:    desc("projects_checked_total", "How many projects have been processed", nil),
+
+		checkState:        desc("check_running", "Current check state", nil),
+		lastCheckDuration: desc("last_check_duration_seconds", "How long the last check was running", nil),
+		lastCheckTime:     desc("last_check_run_finished_seconds", "When the last check happened", nil),
+		nextCheckTime:     desc("next_check_run_scheduled_seconds", "When the next check is scheduled", nil),
+		numberOfScrapes:   desc("number_of_scrapes", "How many times the GitLab API was scraped since the last restart", nil),
+
+		cacheHits:    desc("gitlab_api_cache_hits_total", "How many project pages checks were served from the cache", nil),
+		cacheMisses:  desc("gitlab_api_cache_misses_total", "How many project pages checks had to call the GitLab API", nil),
+		cacheEntries: desc("gitlab_api_cache_entries", "The number of entries currently held in the project cache", nil),
+
+		probeStatusCode:    desc("pages_probe_http_status_code", "The HTTP status code returned by the last probe of the pages URL", probeLabels),
+		probeDuration:      desc("pages_probe_duration_seconds", "How long the last probe of the pages URL took", probeLabels),
+		probeTLSExpiry:     desc("pages_probe_tls_expiry_seconds", "Unix timestamp of the NotAfter date of the certificate served by the pages URL", probeLabels),
+		probeSuccess:       desc("pages_probe_success", "Whether the last probe of the pages URL succeeded", probeLabels),
+		probeRedirectCount: desc("pages_probe_redirect_count", "How many redirects were followed during the last probe of the pages URL", probeLabels),
+		probeResponseSize:  desc("pages_probe_response_size_bytes", "The size of the response body returned by the last probe of the pages URL", probeLabels),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (g *gitlabPagesExporter) Describe(ch chan<- *prometheus.Desc) {
+	d := g.descs
+	ch <- d.projectPages
+	ch <- d.customDomains
+	ch <- d.projectPagesTotal
+	ch <- d.customDomainsTotal
+	ch <- d.projectsChecked
+	ch <- d.checkState
+	ch <- d.lastCheckDuration
+	ch <- d.lastCheckTime
+	ch <- d.nextCheckTime
+	ch <- d.numberOfScrapes
+	ch <- d.cacheHits
+	ch <- d.cacheMisses
+	ch <- d.cacheEntries
+	ch <- d.probeStatusCode
+	ch <- d.probeDuration
+	ch <- d.probeTLSExpiry
+	ch <- d.probeSuccess
+	ch <- d.probeRedirectCount
+	ch <- d.probeResponseSize
+
+	g.apiMetrics.requestsTotal.Describe(ch)
+	g.apiMetrics.requestDuration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector. It never calls the GitLab API
+// itself, it only ever reads the snapshot published by the most recently
+// completed Run, plus a handful of single-value gauges/counters which are
+// cheap to read directly. This guarantees a scrape landing mid-Run still
+// sees a fully coherent view instead of a partially populated one.
+func (g *gitlabPagesExporter) Collect(ch chan<- prometheus.Metric) {
+	d := g.descs
+
+	checkRunning := 0.0
+	if atomic.LoadInt32(&g.checkRunning) == 1 {
+		checkRunning = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(d.checkState, prometheus.GaugeValue, checkRunning)
+	ch <- prometheus.MustNewConstMetric(d.nextCheckTime, prometheus.GaugeValue, float64(atomic.LoadInt64(&g.nextCheckTime)))
+	ch <- prometheus.MustNewConstMetric(d.numberOfScrapes, prometheus.CounterValue, float64(atomic.LoadUint64(&g.numberOfScrapes)))
+	ch <- prometheus.MustNewConstMetric(d.cacheHits, prometheus.CounterValue, float64(atomic.LoadUint64(&g.cacheHits)))
+	ch <- prometheus.MustNewConstMetric(d.cacheMisses, prometheus.CounterValue, float64(atomic.LoadUint64(&g.cacheMisses)))
+	ch <- prometheus.MustNewConstMetric(d.cacheEntries, prometheus.GaugeValue, float64(g.projectCache.Len()))
+
+	g.snapshotMu.RLock()
+	snap := g.snapshot
+	g.snapshotMu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(d.projectPagesTotal, prometheus.GaugeValue, float64(snap.projectPagesTotal))
+	ch <- prometheus.MustNewConstMetric(d.customDomainsTotal, prometheus.GaugeValue, float64(snap.customDomainsTotal))
+	ch <- prometheus.MustNewConstMetric(d.projectsChecked, prometheus.GaugeValue, float64(snap.projectsChecked))
+	ch <- prometheus.MustNewConstMetric(d.lastCheckDuration, prometheus.GaugeValue, snap.lastCheckDuration.Seconds())
+	if !snap.lastCheckTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(d.lastCheckTime, prometheus.GaugeValue, float64(snap.lastCheckTime.Unix()))
+	}
+
+	for _, p := range snap.projectPages {
+		value := 0.0
+		if p.hasPages {
+			value = 1.0
+		}
+		ch <- prometheus.MustNewConstMetric(
+			d.projectPages, prometheus.GaugeValue, value,
+			p.projectID, p.projectName, p.projectWebURL, p.pagesAccessLevel, string(p.checkState),
+		)
+	}
+
+	for _, c := range snap.customDomains {
+		value := 0.0
+		if c.verified {
+			value = 1.0
+		}
+		ch <- prometheus.MustNewConstMetric(d.customDomains, prometheus.GaugeValue, value, c.projectID, c.url)
+	}
+
+	for _, p := range snap.probes {
+		success := 0.0
+		if p.success {
+			success = 1.0
+		}
+		tlsExpiry := 0.0
+		if !p.tlsExpiry.IsZero() {
+			tlsExpiry = float64(p.tlsExpiry.Unix())
+		}
+		ch <- prometheus.MustNewConstMetric(d.probeStatusCode, prometheus.GaugeValue, float64(p.statusCode), p.projectID, p.url)
+		ch <- prometheus.MustNewConstMetric(d.probeDuration, prometheus.GaugeValue, p.duration.Seconds(), p.projectID, p.url)
+		ch <- prometheus.MustNewConstMetric(d.probeTLSExpiry, prometheus.GaugeValue, tlsExpiry, p.projectID, p.url)
+		ch <- prometheus.MustNewConstMetric(d.probeSuccess, prometheus.GaugeValue, success, p.projectID, p.url)
+		ch <- prometheus.MustNewConstMetric(d.probeRedirectCount, prometheus.GaugeValue, float64(p.redirectCount), p.projectID, p.url)
+		ch <- prometheus.MustNewConstMetric(d.probeResponseSize, prometheus.GaugeValue, float64(p.responseSize), p.projectID, p.url)
+	}
+
+	g.apiMetrics.requestsTotal.Collect(ch)
+	g.apiMetrics.requestDuration.Collect(ch)
+}
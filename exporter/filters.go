@@ -0,0 +1,94 @@
+package exporter
+
+import (
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// FiltersConfig bounds which projects handleProjectPages reports on, so one
+// exporter instance can be scoped to a subset of a large GitLab instance.
+type FiltersConfig struct {
+	// IncludeGroups limits scraping to projects in one of these top-level
+	// or nested group paths. Empty means all groups are included.
+	IncludeGroups []string
+	// ExcludeGroups removes projects in one of these group paths.
+	ExcludeGroups []string
+	// IncludeProjectIDs limits scraping to these project IDs. Empty means
+	// all project IDs are included.
+	IncludeProjectIDs []int
+	// ExcludeProjectIDs removes these project IDs.
+	ExcludeProjectIDs []int
+	// Visibility limits scraping to projects with one of these visibility
+	// levels (public, internal, private). Empty means all visibilities are
+	// included.
+	Visibility []string
+}
+
+// apiVisibility returns the single visibility level which can be pushed down
+// into gitlab.ListProjectsOptions. The GitLab API only accepts one
+// visibility value per request, so this is only possible when exactly one
+// value is configured; otherwise visibility is filtered client-side.
+func (f FiltersConfig) apiVisibility() *gitlab.VisibilityValue {
+	if len(f.Visibility) != 1 {
+		return nil
+	}
+	v := gitlab.VisibilityValue(f.Visibility[0])
+	return &v
+}
+
+// matches reports whether project passes all configured filters.
+func (f FiltersConfig) matches(project *gitlab.Project) bool {
+	if len(f.IncludeProjectIDs) > 0 && !containsInt(f.IncludeProjectIDs, project.ID) {
+		return false
+	}
+	if containsInt(f.ExcludeProjectIDs, project.ID) {
+		return false
+	}
+
+	group := ""
+	if project.Namespace != nil {
+		group = project.Namespace.FullPath
+	}
+	if len(f.IncludeGroups) > 0 && !matchesAnyGroup(f.IncludeGroups, group) {
+		return false
+	}
+	if matchesAnyGroup(f.ExcludeGroups, group) {
+		return false
+	}
+
+	if len(f.Visibility) > 0 && !containsString(f.Visibility, string(project.Visibility)) {
+		return false
+	}
+
+	return true
+}
+
+func containsInt(haystack []int, needle int) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyGroup reports whether group is one of groups, or nested under
+// one of them, e.g. group "foo" matches both "foo" and "foo/bar".
+func matchesAnyGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if group == g || strings.HasPrefix(group, g+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// apiHealthTimeout bounds how long the readiness check waits for the
+// configured GitLab instance to answer /api/v4/version.
+const apiHealthTimeout = 5 * time.Second
+
+// Healthz always reports the process as alive. It is meant to be wired up as
+// a Kubernetes liveness probe.
+func (g *gitlabPagesExporter) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// Ready reports whether the exporter is ready to serve meaningful metrics: at
+// least one scrape must have completed and the most recent one must have
+// succeeded, and the configured GitLab instance must currently be reachable.
+// It is meant to be wired up as a Kubernetes readiness probe.
+func (g *gitlabPagesExporter) Ready(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadUint64(&g.numberOfScrapes) == 0 {
+		http.Error(w, "not ready: no scrape has completed yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	g.snapshotMu.RLock()
+	succeeded := g.snapshot.succeeded
+	g.snapshotMu.RUnlock()
+	if !succeeded {
+		http.Error(w, "not ready: the last scrape did not succeed", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), apiHealthTimeout)
+	defer cancel()
+	if _, _, err := g.gitlabClient.Version.GetVersion(gitlab.WithContext(ctx)); err != nil {
+		http.Error(w, "not ready: GitLab API is not reachable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ready"))
+}
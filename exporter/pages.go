@@ -3,11 +3,12 @@ package exporter
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/bossm8/gitlab-pages-exporter/cache"
 	"github.com/xanzy/go-gitlab"
 )
 
@@ -28,248 +29,179 @@ const (
 	PagesJobName string = "pages"
 )
 
-// exporterMetrics holds all metrics the pages exporter provides.
-type exporterMetrics struct {
-	// Metric describing the custom domains added to pages deployments.
-	customDomains *prometheus.GaugeVec
-	// Metric describing which pages have pages deployed.
-	projectPages *prometheus.GaugeVec
-
-	// Additional metrics to show total numbers.
-	// These are required to show timeseries metrics as customDomains and
-	// projectPages get reset on each run.
-	customDomainsTotal *prometheus.GaugeVec
-	projectPagesTotal  *prometheus.GaugeVec
-
-	// Describes the current state of the exporter.
-	checkState *prometheus.GaugeVec
-	// Describes how long the last check took.
-	lastCheckDuration *prometheus.GaugeVec
-	// Describes when the last check finished.
-	lastCheckTime *prometheus.GaugeVec
-	// Describes when the next check is scheduled.
-	nextCheckTime *prometheus.GaugeVec
-
-	// Metric holding the number of scrapes since the last restart.
-	numberOfScrapes *prometheus.CounterVec
-
-	// Holds the total number of projects which were checked. This metric
-	// is added because per default the exporter does not add projects which
-	// do not expose pages to the metrics to limit the number of unique metrics
-	// exposed to prometheus (cardinality).
-	projectsChecked *prometheus.GaugeVec
+// projectPagesResult is the per-project data exposed as the
+// project_pages_enabled metric.
+type projectPagesResult struct {
+	projectID        string
+	projectName      string
+	projectWebURL    string
+	pagesAccessLevel string
+	checkState       CheckState
+	hasPages         bool
 }
 
-// clearPagesMetrics clears the custom domain and pages metrics on the exporter
-// This must be called before each run, as otherwise there will be stale metrics
-// when for example a custom domain changes.
-func (m *exporterMetrics) clearPagesMetrics() {
-	m.customDomains.Reset()
-	m.projectPages.Reset()
+// customDomainResult is the per-domain data exposed as the
+// custom_domains_verified metric.
+type customDomainResult struct {
+	projectID string
+	url       string
+	verified  bool
 }
 
-// setCheckStateRunning adjusts the prometheus metrics to show a running state.
-func (m *exporterMetrics) setCheckStateRunning() {
-	m.checkState.WithLabelValues().Set(1.0)
+// scrapeSnapshot holds a coherent, point-in-time view of everything gathered
+// during a single Run. It is built up entirely by the scraper goroutine and
+// only ever published to the exporter's snapshot field once complete, so a
+// Collect racing with an in-flight Run always sees either the previous or
+// the current snapshot, never a partially populated one.
+type scrapeSnapshot struct {
+	projectPages       []projectPagesResult
+	customDomains      []customDomainResult
+	probes             []probeResult
+	projectsChecked    int
+	projectPagesTotal  int
+	customDomainsTotal int
+	lastCheckDuration  time.Duration
+	lastCheckTime      time.Time
+	// succeeded is false if listing the projects or the custom domains
+	// failed. A failed pages job check of a single project does not clear
+	// it, it is reported through that project's check_status label instead.
+	// Used to answer the /ready probe.
+	succeeded bool
 }
 
-// setCheckStateRunning adjusts the prometheus metrics to show a scheduled state.
-func (m *exporterMetrics) setCheckStateFinished() {
-	m.checkState.WithLabelValues().Set(0.0)
-}
+// gitlabPagesExporter holds the actual exporter logic and implements
+// prometheus.Collector so that /metrics always serves a coherent snapshot
+// instead of being mutated in place while a scrape is running.
+type gitlabPagesExporter struct {
+	gitlabClient *gitlab.Client
 
-// setNextRun sets the metric showing the next schedule to next.
-func (m *exporterMetrics) setNextRun(next int64) {
-	m.nextCheckTime.WithLabelValues().Set(float64(next))
-}
+	// setMetricsForProjectsWithoutPages defines if all projects should be added
+	// to prometheus metrics or only the ones actually exposing pages.
+	setMetricsForProjectsWithoutPages bool
 
-// setLastCheckMetrics sets the metrics holding information about the last check
-// which was run.
-func (m *exporterMetrics) setLastCheckMetrics(elapsed *time.Duration) {
-	m.lastCheckDuration.WithLabelValues().Set(elapsed.Seconds())
-	m.lastCheckTime.WithLabelValues().SetToCurrentTime()
-}
+	// prober holds the configuration of the optional blackbox-style pages
+	// prober.
+	prober ProberConfig
 
-// setNumberOfProjects sets the metric holding the number of total projects
-// checked to n.
-func (m *exporterMetrics) setNumberOfProjects(n *int) {
-	m.projectsChecked.WithLabelValues().Set(float64(*n))
-}
+	// projectCache caches the result of the last successful pages job check
+	// per project so unchanged projects do not need to be re-checked via
+	// the GitLab API on every scrape.
+	projectCache *cache.ProjectCache
 
-// setCustomDomainMetrics exposes the domain passed as prometheus metric with
-// the value showing the verification status of the domain.
-func (m *exporterMetrics) setCustomDomainMetrics(domain *gitlab.PagesDomain) {
-	value := 1.0
-	if !domain.Verified {
-		value = 0.0
-	}
-	m.customDomains.WithLabelValues(
-		fmt.Sprintf("%d", domain.ProjectID),
-		domain.URL,
-	).Set(value)
-}
+	// filters bounds which projects are reported on.
+	filters FiltersConfig
 
-// increaseNumberOfScrapes increases the scrape runs metric.
-func (m *exporterMetrics) increaseNumberOfScrapes() {
-	m.numberOfScrapes.WithLabelValues().Inc()
-}
+	// workerConcurrency bounds how many projects are checked for pages jobs
+	// concurrently within a single page of handleProjectPages results,
+	// configurable via GPE_WORKER_CONCURRENCY.
+	workerConcurrency int
 
-// setTotalCustomDomains sets the number of custom domains to total.
-func (m *exporterMetrics) setTotalCustomDomains(total *int) {
-	m.customDomainsTotal.WithLabelValues().Set(float64(*total))
-}
+	// apiMetrics tracks outgoing GitLab API requests made through
+	// gitlabClient, recorded by the rate limiting transport it was built
+	// with.
+	apiMetrics *apiRequestMetrics
 
-// setTotalProjectPages sets the number of projects with pages enabled to total.
-func (m *exporterMetrics) setTotalProjectPages(total *int) {
-	m.projectPagesTotal.WithLabelValues().Set(float64(*total))
-}
+	descs *metricDescs
 
-// setProjectPagesMetrics exposes the the project passed as prometheus metric
-// the value of the metric will be hasPages (0/1) with the additional label
-// check_state set to checkState.
-func (m *exporterMetrics) setProjectPagesMetrics(
-	project *gitlab.Project,
-	hasPages bool,
-	checkState CheckState,
-) {
-	value := 1.0
-	if !hasPages {
-		value = 0.0
-	}
-	m.projectPages.WithLabelValues(
-		fmt.Sprintf("%d", project.ID),
-		project.Name,
-		project.WebURL,
-		string(project.PagesAccessLevel),
-		string(checkState),
-	).Set(value)
-}
+	// snapshotMu guards snapshot. Collect only ever takes a read lock, so
+	// scrapes never block a Prometheus scrape and vice versa.
+	snapshotMu sync.RWMutex
+	snapshot   scrapeSnapshot
 
-// gitlabPagesExporter holds the actual exporter logic
-type gitlabPagesExporter struct {
-	gitlabClient *gitlab.Client
+	// checkRunning, numberOfScrapes and nextCheckTime are plain single-value
+	// gauges/counters without per-entity cardinality, so they are safe to
+	// update outside of the snapshot as soon as they change.
+	checkRunning    int32
+	numberOfScrapes uint64
+	nextCheckTime   int64
 
-	// setMetricsForProjectWithoutPages defines if all projects should be added
-	// to prometheus metrics or only the ones actually exposing pages.
-	setMetricsForProjectsWithoutPages bool
+	cacheHits   uint64
+	cacheMisses uint64
+}
 
-	metrics *exporterMetrics
+// Config holds everything needed to construct a gitlabPagesExporter.
+type Config struct {
+	// APIURL is the base URL of the GitLab instance to scrape.
+	APIURL string
+	// AdminToken is the GitLab admin read token used to authenticate API
+	// calls.
+	AdminToken string
+	// SetMetricsForProjectsWithoutPages defines if all projects should be
+	// added to prometheus metrics or only the ones actually exposing pages.
+	SetMetricsForProjectsWithoutPages bool
+	// Prober holds the configuration of the optional blackbox-style pages
+	// prober.
+	Prober ProberConfig
+	// CacheTTL is how long a project's pages job check is cached for.
+	CacheTTL time.Duration
+	// Filters bounds which projects are reported on.
+	Filters FiltersConfig
+	// WorkerConcurrency bounds how many projects are checked for pages jobs
+	// concurrently within a single page of project results.
+	WorkerConcurrency int
+	// RateLimit configures the token-bucket limiter applied to outgoing
+	// GitLab API requests.
+	RateLimit RateLimitConfig
 }
 
 // NewGitlabPagesExporter creates a new instance of the exporter. Checks can be
-// started with .Run().
-func NewGitlabPagesExporter(
-	apiUrl string,
-	adminToken string,
-	setMetricsForProjectsWithoutPages bool,
-) *gitlabPagesExporter {
-	git, err := gitlab.NewClient(adminToken, gitlab.WithBaseURL(apiUrl))
+// started with .Run(). Register it with a prometheus.Registry to expose its
+// metrics.
+func NewGitlabPagesExporter(cfg Config) *gitlabPagesExporter {
+	apiMetrics := newAPIRequestMetrics()
+
+	httpClient := &http.Client{
+		Transport: newRateLimitedTransport(cfg.RateLimit, apiMetrics),
+	}
+	git, err := gitlab.NewClient(
+		cfg.AdminToken,
+		gitlab.WithBaseURL(cfg.APIURL),
+		gitlab.WithHTTPClient(httpClient),
+	)
 	if err != nil {
 		log.Fatalf("ERROR: Failed to create GitLab client: %s", err)
 	}
 
+	workerConcurrency := cfg.WorkerConcurrency
+	if workerConcurrency <= 0 {
+		workerConcurrency = 10
+	}
+
+	prober := cfg.Prober
+	if prober.Concurrency <= 0 {
+		prober.Concurrency = 10
+	}
+
 	return &gitlabPagesExporter{
 		gitlabClient:                      git,
-		setMetricsForProjectsWithoutPages: setMetricsForProjectsWithoutPages,
-		metrics: &exporterMetrics{
-			projectPages: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "project_pages_enabled",
-					Help:      "If GitLab pages are enabled for the project",
-				},
-				[]string{
-					"project_id",
-					"project_name",
-					"project_web_url",
-					"pages_access_level",
-					"check_status",
-				},
-			),
-			customDomains: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "custom_domains_verified",
-					Help:      "Custom domain verification status",
-				},
-				[]string{
-					"project_id",
-					"pages_domain",
-				},
-			),
-			projectPagesTotal: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "project_pages_total",
-					Help:      "Shows the total number of projects which have pages deployed",
-				},
-				[]string{},
-			),
-			customDomainsTotal: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "custom_domains_total",
-					Help:      "Shows the total number of custom domains added",
-				},
-				[]string{},
-			),
-			projectsChecked: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "projects_checked_total",
-					Help:      "How many projects have been processed",
-				},
-				[]string{},
-			),
-			numberOfScrapes: promauto.NewCounterVec(
-				prometheus.CounterOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "number_of_scrapes",
-					Help:      "How many times the GitLab API was scraped since the last restart",
-				},
-				[]string{},
-			),
-			checkState: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "check_running",
-					Help:      "Current check state",
-				},
-				[]string{},
-			),
-			lastCheckDuration: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "last_check_duration_seconds",
-					Help:      "How long the last check was running",
-				},
-				[]string{},
-			),
-			lastCheckTime: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "last_check_run_finished_seconds",
-					Help:      "When the last check happened",
-				},
-				[]string{},
-			),
-			nextCheckTime: promauto.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Namespace: PrometheusNamespace,
-					Name:      "next_check_run_scheduled_seconds",
-					Help:      "When the next check is scheduled",
-				},
-				[]string{},
-			),
-		},
+		setMetricsForProjectsWithoutPages: cfg.SetMetricsForProjectsWithoutPages,
+		prober:                            prober,
+		projectCache:                      cache.New(cfg.CacheTTL),
+		filters:                           cfg.Filters,
+		workerConcurrency:                 workerConcurrency,
+		apiMetrics:                        apiMetrics,
+		descs:                             newMetricDescs(),
 	}
 }
 
 // checkProjectForPagesJob checks the given project if CI/CD is enabled and
-// if so if there is a successful job named PagesJobName.
+// if so if there is a successful job named PagesJobName. If the project's
+// last_activity_at matches a fresh cache entry the GitLab API is not called
+// and the cached result is returned instead.
 func (g *gitlabPagesExporter) checkProjectForPagesJob(
 	project *gitlab.Project,
 ) (hasPagesJob bool, checkState CheckState) {
+	var lastActivityAt time.Time
+	if project.LastActivityAt != nil {
+		lastActivityAt = *project.LastActivityAt
+	}
+
+	if entry, ok := g.projectCache.Get(project.ID, lastActivityAt); ok {
+		atomic.AddUint64(&g.cacheHits, 1)
+		return entry.HasPagesJob, CheckState(entry.CheckState)
+	}
+	atomic.AddUint64(&g.cacheMisses, 1)
+
 	hasPagesJob = false
 	checkState = Succeeded
 
@@ -297,113 +229,184 @@ func (g *gitlabPagesExporter) checkProjectForPagesJob(
 		}
 	}
 
+	if checkState == Succeeded {
+		g.projectCache.Set(project.ID, lastActivityAt, hasPagesJob, string(checkState))
+	}
+
 	return
 }
 
 // handleProjectPages checks the GitLab API for projects which got pages
-// deployments and adds the results to the corresponding prometheus metrics.
+// deployments and returns the resulting metrics together with the list of
+// projects which should be probed.
 // Unfortunately there is no built-in way via the API to gather information
 // about pages, thus the information is gathered by checking each project if
 // it has CI/CD enabled and if so if there is a job named pages (which is
 // mandatory for pages to be deployed).
+// Per-project checks within a page of results run concurrently, bounded by
+// a semaphore sized at g.workerConcurrency, to stay within GitLab's API rate
+// limits on large instances.
 // https://docs.gitlab.com/ee/user/project/pages/#how-it-works
-func (g *gitlabPagesExporter) handleProjectPages() {
-	start := time.Now()
+func (g *gitlabPagesExporter) handleProjectPages() (
+	results []projectPagesResult,
+	pagesProjects []*gitlab.Project,
+	totalProjects int,
+	totalProjectPages int,
+	succeeded bool,
+) {
 	projOpts := &gitlab.ListProjectsOptions{
-		OrderBy: gitlab.String("id"),
-		Sort:    gitlab.String("asc"),
+		OrderBy:    gitlab.String("id"),
+		Sort:       gitlab.String("asc"),
+		Visibility: g.filters.apiVisibility(),
 		ListOptions: gitlab.ListOptions{
 			PerPage: 100,
 			Page:    0,
 		},
 	}
 
-	totalProjects := 0
-	totalProjectPages := 0
+	var mu sync.Mutex
+	sem := make(chan struct{}, g.workerConcurrency)
+	succeeded = true
 
 	for {
 		projects, resp, err := g.gitlabClient.Projects.ListProjects(projOpts)
 		if err != nil {
 			log.Printf("ERROR Failed to get GitLab projects: %s", err)
+			succeeded = false
+			return
 		}
 
 		var wg sync.WaitGroup
 		for _, project := range projects {
+			if !g.filters.matches(project) {
+				continue
+			}
+			totalProjects++
+
 			wg.Add(1)
+			sem <- struct{}{}
 			go func(project *gitlab.Project) {
 				defer wg.Done()
+				defer func() { <-sem }()
 				hasPagesJob, checkState := g.checkProjectForPagesJob(project)
 				if !hasPagesJob && !g.setMetricsForProjectsWithoutPages {
 					return
-				} else if hasPagesJob {
-					totalProjectPages += 1
 				}
-				g.metrics.setProjectPagesMetrics(project, hasPagesJob, checkState)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if hasPagesJob {
+					totalProjectPages++
+					pagesProjects = append(pagesProjects, project)
+				}
+				results = append(results, projectPagesResult{
+					projectID:        fmt.Sprintf("%d", project.ID),
+					projectName:      project.Name,
+					projectWebURL:    project.WebURL,
+					pagesAccessLevel: string(project.PagesAccessLevel),
+					checkState:       checkState,
+					hasPages:         hasPagesJob,
+				})
 			}(project)
 		}
 		wg.Wait()
 
-		log.Printf("INFO: Handled %d of %d pages Ã  %d projects",
+		log.Printf("INFO: Handled %d of %d pages Ã  %d projects",
 			resp.CurrentPage,
 			resp.TotalPages,
 			resp.ItemsPerPage,
 		)
 		projOpts.Page = resp.NextPage
-		totalProjects = totalProjects + len(projects)
 
 		if resp.NextPage == 0 {
 			break
 		}
 	}
 
-	elapsed := time.Since(start)
-	log.Printf("INFO: Got %d projects in %s of which %d have deployed pages",
-		totalProjects,
-		elapsed.Round(time.Second),
-		totalProjectPages,
-	)
-
-	g.metrics.setNumberOfProjects(&totalProjects)
-	g.metrics.setTotalProjectPages(&totalProjectPages)
-	g.metrics.setLastCheckMetrics(&elapsed)
+	return
 }
 
-// handleCustomDomains checks the GitLab API for custom domains and adds the
-// results to the corresponding prometheus metrics.
+// handleCustomDomains checks the GitLab API for custom domains and returns
+// the resulting metrics together with the raw domains, which are needed by
+// the prober.
 // https://docs.gitlab.com/ee/api/pages_domains.html
-func (g *gitlabPagesExporter) handleCustomDomains() {
-	start := time.Now()
-	customDomains, _, err := g.gitlabClient.PagesDomains.ListAllPagesDomains()
+func (g *gitlabPagesExporter) handleCustomDomains() (
+	results []customDomainResult,
+	domains []*gitlab.PagesDomain,
+	succeeded bool,
+) {
+	domains, _, err := g.gitlabClient.PagesDomains.ListAllPagesDomains()
 	if err != nil {
 		log.Printf("ERROR: Failed to get GitLab custom domains: %s", err)
+		return nil, nil, false
 	}
-
-	for _, domain := range customDomains {
-		go g.metrics.setCustomDomainMetrics(domain)
+	succeeded = true
+
+	for _, domain := range domains {
+		results = append(results, customDomainResult{
+			projectID: fmt.Sprintf("%d", domain.ProjectID),
+			url:       domain.URL,
+			verified:  domain.Verified,
+		})
 	}
 
-	elapsed := time.Since(start)
-	totalCustomDomains := len(customDomains)
-	g.metrics.setTotalCustomDomains(&totalCustomDomains)
-	log.Printf("INFO: Got %d custom domains in %s",
-		totalCustomDomains,
-		elapsed.Round(time.Second),
-	)
+	return
 }
 
 // Run runs a new scrape against the GitLab API to gather information about
-// each project.
+// each project and publishes the result as a new, coherent snapshot once it
+// completes.
 func (g *gitlabPagesExporter) Run(next int64) {
-	g.metrics.setNextRun(next)
-	g.metrics.setCheckStateRunning()
-	g.metrics.clearPagesMetrics()
+	atomic.StoreInt64(&g.nextCheckTime, next)
+	atomic.StoreInt32(&g.checkRunning, 1)
 
+	start := time.Now()
 	log.Printf("INFO: Starting new scrape of GitLab pages on instance %s",
 		g.gitlabClient.BaseURL(),
 	)
-	go g.handleCustomDomains()
-	g.handleProjectPages()
 
-	g.metrics.setCheckStateFinished()
-	g.metrics.increaseNumberOfScrapes()
+	var customDomainResults []customDomainResult
+	var domains []*gitlab.PagesDomain
+	var domainsSucceeded bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		customDomainResults, domains, domainsSucceeded = g.handleCustomDomains()
+	}()
+
+	projectResults, pagesProjects, totalProjects, totalProjectPages, projectsSucceeded := g.handleProjectPages()
+	wg.Wait()
+
+	var probes []probeResult
+	probes = append(probes, g.probeProjects(pagesProjects)...)
+	probes = append(probes, g.probeCustomDomains(domains)...)
+
+	elapsed := time.Since(start)
+	log.Printf("INFO: Got %d projects in %s of which %d have deployed pages and %d custom domains",
+		totalProjects,
+		elapsed.Round(time.Second),
+		totalProjectPages,
+		len(domains),
+	)
+
+	evicted := g.projectCache.Evict()
+	log.Printf("INFO: Evicted %d expired entries from the project cache", evicted)
+
+	g.snapshotMu.Lock()
+	g.snapshot = scrapeSnapshot{
+		projectPages:       projectResults,
+		customDomains:      customDomainResults,
+		probes:             probes,
+		projectsChecked:    totalProjects,
+		projectPagesTotal:  totalProjectPages,
+		customDomainsTotal: len(domains),
+		lastCheckDuration:  elapsed,
+		lastCheckTime:      time.Now(),
+		succeeded:          projectsSucceeded && domainsSucceeded,
+	}
+	g.snapshotMu.Unlock()
+
+	atomic.StoreInt32(&g.checkRunning, 0)
+	atomic.AddUint64(&g.numberOfScrapes, 1)
 }
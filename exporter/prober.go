@@ -0,0 +1,178 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// probeResult is the outcome of probing a single pages URL, exposed as the
+// pages_probe_* metrics.
+type probeResult struct {
+	projectID     string
+	url           string
+	statusCode    int
+	duration      time.Duration
+	tlsExpiry     time.Time
+	redirectCount int
+	responseSize  int64
+	success       bool
+}
+
+// ProberConfig holds the configuration required to run the blackbox pages
+// prober.
+type ProberConfig struct {
+	// Enabled defines if pages URLs are probed at all, toggled via
+	// GPE_PROBE_PAGES.
+	Enabled bool
+	// Concurrency is the number of probes which may be in flight at the
+	// same time, configurable via GPE_PROBE_CONCURRENCY. Values <= 0 are
+	// clamped to a default of 10 by NewGitlabPagesExporter.
+	Concurrency int
+	// Timeout is the per-request timeout applied to every probe,
+	// configurable via GPE_PROBE_TIMEOUT.
+	Timeout time.Duration
+	// PagesDomain is the GitLab instance wide pages domain used to build
+	// the pages URL of a project when it does not expose one explicitly.
+	PagesDomain string
+}
+
+// buildProjectPagesURL returns the URL under which the pages site of project
+// is expected to be reachable. If the GitLab API already knows about a pages
+// environment for the project its external URL is used, otherwise the URL is
+// derived from the project namespace and the configured pages domain. It
+// returns an empty string if neither is possible, e.g. when project.Namespace
+// is nil.
+// https://docs.gitlab.com/ee/user/project/pages/getting_started_part_one.html#url-structure
+func (g *gitlabPagesExporter) buildProjectPagesURL(project *gitlab.Project) string {
+	envs, _, err := g.gitlabClient.Environments.ListEnvironments(
+		project.ID,
+		&gitlab.ListEnvironmentsOptions{Name: gitlab.String("pages")},
+	)
+	if err == nil {
+		for _, env := range envs {
+			if env.ExternalURL != "" {
+				return env.ExternalURL
+			}
+		}
+	}
+
+	if project.Namespace == nil {
+		log.Printf("ERROR: Cannot derive pages URL for project %s: namespace is unknown", project.WebURL)
+		return ""
+	}
+
+	namespace := project.Namespace.Path
+	return fmt.Sprintf("https://%s.%s/%s", namespace, g.prober.PagesDomain, project.Path)
+}
+
+// probe issues a real HTTP(S) GET against url and returns the outcome as a
+// probeResult, including the number of redirects followed and the size of
+// the final response body. It is safe to call from multiple goroutines
+// concurrently, bound by the configured worker pool.
+func (g *gitlabPagesExporter) probe(projectID string, url string) probeResult {
+	result := probeResult{projectID: projectID, url: url}
+
+	if url == "" {
+		log.Printf("ERROR: Skipping probe for project %s: no pages URL could be determined", projectID)
+		return result
+	}
+
+	client := &http.Client{
+		Timeout: g.prober.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			result.redirectCount = len(via)
+			// Preserve net/http's default cap of 10 redirects, which a nil
+			// CheckRedirect would otherwise apply automatically.
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return nil
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Get(url)
+	result.duration = time.Since(start)
+
+	if err != nil {
+		log.Printf("ERROR: Failed to probe pages URL %s: %s", url, err)
+		return result
+	}
+	defer resp.Body.Close()
+
+	size, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		log.Printf("ERROR: Failed to read response body while probing %s: %s", url, err)
+	}
+	result.responseSize = size
+
+	result.statusCode = resp.StatusCode
+	result.success = resp.StatusCode < 400
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		result.tlsExpiry = resp.TLS.PeerCertificates[0].NotAfter
+	}
+
+	return result
+}
+
+// probeProjects probes the pages URL of every project in projects which has
+// a pages job, bounded by the configured probe concurrency.
+func (g *gitlabPagesExporter) probeProjects(projects []*gitlab.Project) []probeResult {
+	if !g.prober.Enabled {
+		return nil
+	}
+
+	sem := make(chan struct{}, g.prober.Concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []probeResult
+	for _, project := range projects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(project *gitlab.Project) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := g.probe(fmt.Sprintf("%d", project.ID), g.buildProjectPagesURL(project))
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(project)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// probeCustomDomains probes the public URL of every custom pages domain in
+// domains, bounded by the configured probe concurrency.
+func (g *gitlabPagesExporter) probeCustomDomains(domains []*gitlab.PagesDomain) []probeResult {
+	if !g.prober.Enabled {
+		return nil
+	}
+
+	sem := make(chan struct{}, g.prober.Concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []probeResult
+	for _, domain := range domains {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(domain *gitlab.PagesDomain) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := g.probe(fmt.Sprintf("%d", domain.ProjectID), domain.URL)
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(domain)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -8,7 +8,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/bossm8/gitlab-pages-exporter/config"
 	"github.com/bossm8/gitlab-pages-exporter/exporter"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robfig/cron"
 
@@ -20,6 +22,7 @@ var version string = "dev"
 func main() {
 
 	v := flag.Bool("v", false, "Print version info")
+	configPath := flag.String("config", "", "Path to a YAML or TOML config file")
 	flag.Parse()
 
 	if *v {
@@ -27,40 +30,60 @@ func main() {
 		os.Exit(0)
 	}
 
-	token := os.Getenv("GPE_GITLAB_ADMIN_READ_TOKEN")
-	if token == "" {
-		log.Fatal("ERROR: GPE_GITLAB_ADMIN_READ_TOKEN needs to be set")
+	cfg := &config.Config{}
+	if *configPath != "" {
+		loaded, err := config.Load(*configPath)
+		if err != nil {
+			log.Fatalf("ERROR: Failed to load config file: %s", err)
+		}
+		cfg = loaded
 	}
-
-	apiUrl := os.Getenv("GPE_GITLAB_API_URL")
-	if apiUrl == "" {
-		log.Fatal("ERROR: GPE_GITLAB_API_URL needs to be set")
+	if err := cfg.ApplyEnvOverrides(); err != nil {
+		log.Fatalf("ERROR: %s", err)
 	}
 
-	schedule := os.Getenv("GPE_CRON_SCHEDULE")
-	if schedule == "" {
-		log.Println("INFO: Setting GPE_CRON_SCHEDULE to default (0 0 2 * * *)")
-		schedule = "0 0 2 * * *"
+	if cfg.Gitlab.Token == "" {
+		log.Fatal("ERROR: GPE_GITLAB_ADMIN_READ_TOKEN or gitlab.token/gitlab.token_file needs to be set")
+	}
+	if cfg.Gitlab.APIURL == "" {
+		log.Fatal("ERROR: GPE_GITLAB_API_URL or gitlab.api_url needs to be set")
 	}
 
-	setAllMetrics := false
-	setAllMetricsStr := os.Getenv("GPE_SET_ALL_PROJECT_METRICS")
-	if setAllMetricsStr != "" {
-		var err error
-		if setAllMetrics, err = strconv.ParseBool(setAllMetricsStr); err != nil {
-			log.Fatalf(
-				"ERROR: GPE_SET_ALL_PROJECT_METRICS must be valid boolean value, %s",
-				err,
-			)
-		}
+	if cfg.Schedule.Cron == "" {
+		log.Println("INFO: Setting cron schedule to default (0 0 2 * * *)")
+		cfg.Schedule.Cron = "0 0 2 * * *"
 	}
 
-	sched, err := cron.Parse(schedule)
+	sched, err := cron.Parse(cfg.Schedule.Cron)
 	if err != nil {
 		log.Fatalf("ERROR: Could not parse cron schedule: %s", err)
 	}
 
-	exp := exporter.NewGitlabPagesExporter(apiUrl, token, setAllMetrics)
+	prober := loadProberConfig()
+	cacheTTL := loadCacheTTL()
+	workerConcurrency := loadWorkerConcurrency()
+	rateLimit := loadRateLimitConfig()
+
+	exp := exporter.NewGitlabPagesExporter(exporter.Config{
+		APIURL:                            cfg.Gitlab.APIURL,
+		AdminToken:                        cfg.Gitlab.Token,
+		SetMetricsForProjectsWithoutPages: cfg.SetAllProjectMetrics,
+		Prober:                            prober,
+		CacheTTL:                          cacheTTL,
+		WorkerConcurrency:                 workerConcurrency,
+		RateLimit:                         rateLimit,
+		Filters: exporter.FiltersConfig{
+			IncludeGroups:     cfg.Filters.IncludeGroups,
+			ExcludeGroups:     cfg.Filters.ExcludeGroups,
+			IncludeProjectIDs: cfg.Filters.IncludeProjectIDs,
+			ExcludeProjectIDs: cfg.Filters.ExcludeProjectIDs,
+			Visibility:        cfg.Filters.Visibility,
+		},
+	})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exp)
+
 	runScrape := func() {
 		next := sched.Next(time.Now())
 		exp.Run(next.Unix())
@@ -74,13 +97,137 @@ func main() {
 	go runScrape()
 
 	c := cron.New()
-	if err = c.AddFunc(schedule, runScrape); err != nil {
+	if err = c.AddFunc(cfg.Schedule.Cron, runScrape); err != nil {
 		log.Fatalf("ERROR: Could not start cron schedule: %s", err)
 	}
 	go c.Run()
 
-	log.Println("INFO: Starting metrics server at :2112")
+	metricsAddr := cfg.Listen.MetricsAddr
+	if metricsAddr == "" {
+		metricsAddr = ":2112"
+	}
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	if cfg.Listen.AdminAddr == "" {
+		metricsMux.HandleFunc("/healthz", exp.Healthz)
+		metricsMux.HandleFunc("/ready", exp.Ready)
+	} else {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/healthz", exp.Healthz)
+		adminMux.HandleFunc("/ready", exp.Ready)
+
+		log.Printf("INFO: Starting admin server at %s", cfg.Listen.AdminAddr)
+		log.Println("INFO: /healthz and /ready will be served there")
+		go func() {
+			if err := http.ListenAndServe(cfg.Listen.AdminAddr, adminMux); err != nil {
+				log.Fatalf("ERROR: Admin server failed: %s", err)
+			}
+		}()
+	}
+
+	log.Printf("INFO: Starting metrics server at %s", metricsAddr)
 	log.Println("INFO: Metrics will be served under /metrics")
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":2112", nil)
+	http.ListenAndServe(metricsAddr, metricsMux)
+}
+
+// loadProberConfig reads the GPE_PROBE_* environment variables and returns
+// the resulting exporter.ProberConfig. Probing is disabled unless
+// GPE_PROBE_PAGES is set to true.
+func loadProberConfig() exporter.ProberConfig {
+	enabled := false
+	enabledStr := os.Getenv("GPE_PROBE_PAGES")
+	if enabledStr != "" {
+		var err error
+		if enabled, err = strconv.ParseBool(enabledStr); err != nil {
+			log.Fatalf("ERROR: GPE_PROBE_PAGES must be a valid boolean value, %s", err)
+		}
+	}
+
+	pagesDomain := os.Getenv("GPE_PAGES_DOMAIN")
+	if enabled && pagesDomain == "" {
+		log.Fatal("ERROR: GPE_PAGES_DOMAIN needs to be set when GPE_PROBE_PAGES is true")
+	}
+
+	concurrency := 10
+	concurrencyStr := os.Getenv("GPE_PROBE_CONCURRENCY")
+	if concurrencyStr != "" {
+		var err error
+		if concurrency, err = strconv.Atoi(concurrencyStr); err != nil {
+			log.Fatalf("ERROR: GPE_PROBE_CONCURRENCY must be a valid integer, %s", err)
+		}
+	}
+
+	timeout := 10 * time.Second
+	timeoutStr := os.Getenv("GPE_PROBE_TIMEOUT")
+	if timeoutStr != "" {
+		var err error
+		if timeout, err = time.ParseDuration(timeoutStr); err != nil {
+			log.Fatalf("ERROR: GPE_PROBE_TIMEOUT must be a valid duration, %s", err)
+		}
+	}
+
+	return exporter.ProberConfig{
+		Enabled:     enabled,
+		Concurrency: concurrency,
+		Timeout:     timeout,
+		PagesDomain: pagesDomain,
+	}
+}
+
+// loadCacheTTL reads GPE_CACHE_TTL and returns the resulting duration.
+// Defaults to 24 hours, which covers the default once-daily cron schedule.
+func loadCacheTTL() time.Duration {
+	ttl := 24 * time.Hour
+	ttlStr := os.Getenv("GPE_CACHE_TTL")
+	if ttlStr != "" {
+		var err error
+		if ttl, err = time.ParseDuration(ttlStr); err != nil {
+			log.Fatalf("ERROR: GPE_CACHE_TTL must be a valid duration, %s", err)
+		}
+	}
+	return ttl
+}
+
+// loadWorkerConcurrency reads GPE_WORKER_CONCURRENCY and returns the
+// resulting worker pool size. Defaults to 10.
+func loadWorkerConcurrency() int {
+	concurrency := 10
+	concurrencyStr := os.Getenv("GPE_WORKER_CONCURRENCY")
+	if concurrencyStr != "" {
+		var err error
+		if concurrency, err = strconv.Atoi(concurrencyStr); err != nil {
+			log.Fatalf("ERROR: GPE_WORKER_CONCURRENCY must be a valid integer, %s", err)
+		}
+	}
+	return concurrency
+}
+
+// loadRateLimitConfig reads the GPE_API_RATE_* environment variables and
+// returns the resulting exporter.RateLimitConfig. Rate limiting is disabled
+// unless GPE_API_RATE_LIMIT is set to a positive value.
+func loadRateLimitConfig() exporter.RateLimitConfig {
+	var requestsPerSecond float64
+	requestsPerSecondStr := os.Getenv("GPE_API_RATE_LIMIT")
+	if requestsPerSecondStr != "" {
+		var err error
+		if requestsPerSecond, err = strconv.ParseFloat(requestsPerSecondStr, 64); err != nil {
+			log.Fatalf("ERROR: GPE_API_RATE_LIMIT must be a valid number, %s", err)
+		}
+	}
+
+	burst := 1
+	burstStr := os.Getenv("GPE_API_RATE_BURST")
+	if burstStr != "" {
+		var err error
+		if burst, err = strconv.Atoi(burstStr); err != nil {
+			log.Fatalf("ERROR: GPE_API_RATE_BURST must be a valid integer, %s", err)
+		}
+	}
+
+	return exporter.RateLimitConfig{
+		RequestsPerSecond: requestsPerSecond,
+		Burst:             burst,
+	}
 }